@@ -2,17 +2,38 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/jwalton/gchalk"
+	"golang.org/x/sync/semaphore"
 )
 
+// ringBufferSize bounds how many pending chunks a fileWriter's ring may hold
+// before the -on-full policy kicks in.
+const ringBufferSize = 256
+
+// flushInterval is how often a fileWriter's consumer goroutine flushes
+// buffered output that hasn't already hit the high-water mark, so a slow
+// trickle of small chunks doesn't sit unflushed indefinitely.
+const flushInterval = 200 * time.Millisecond
+
+// highWaterBytes is the buffered-output threshold past which a fileWriter
+// flushes immediately instead of waiting for the next tick of flushInterval.
+const highWaterBytes = 4096
+
 const (
 	brightGreen = iota
 	brightYellow
@@ -32,6 +53,10 @@ const (
 var useColour = true // use colour - defaults to true
 var c chan (os.Signal)
 
+// hup is a dedicated channel for SIGHUP so log-rotation tools like logrotate
+// can tell us to reopen our output files without tearing the process down.
+var hup chan (os.Signal)
+
 // Used to prevent exit on siging with -i option
 var doneChannel = make(chan bool)
 
@@ -40,6 +65,7 @@ var fileContainer *container
 
 func init() {
 	c = make(chan os.Signal, 1)
+	hup = make(chan os.Signal, 1)
 	fileContainer = newContainer()
 
 	br := bufio.NewReader(os.Stdin)
@@ -48,59 +74,286 @@ func init() {
 	readWriter = bufio.NewReadWriter(br, bw)
 }
 
+// onFullPolicy controls what a fileWriter does when its ring buffer is full
+// and the dispatcher has another chunk to hand it.
+type onFullPolicy int
+
+const (
+	// onFullBlock makes the dispatcher wait for room in the ring, applying
+	// back-pressure to whichever sink is full. Other sinks are unaffected
+	// within a single write call (each is dispatched to concurrently), but
+	// a sink that stays full keeps blocking every subsequent write, which
+	// in turn back-pressures stdin the same way a plain serial tee would.
+	onFullBlock onFullPolicy = iota
+	// onFullDrop silently discards the chunk and keeps the sink active.
+	onFullDrop
+	// onFullDisconnect discards the chunk and marks the sink inactive, so
+	// it stops receiving further chunks until a SIGHUP reopen.
+	onFullDisconnect
+)
+
+// parseOnFullPolicy parses the -on-full flag value.
+func parseOnFullPolicy(s string) (onFullPolicy, error) {
+	switch s {
+	case "", "block":
+		return onFullBlock, nil
+	case "drop":
+		return onFullDrop, nil
+	case "disconnect":
+		return onFullDisconnect, nil
+	default:
+		return onFullBlock, fmt.Errorf("unknown -on-full policy %q", s)
+	}
+}
+
+// fileWriterOptions bundles the per-sink knobs a fileWriter can be created
+// with. It exists so addFileWriter/newFileWriter don't keep growing a
+// positional parameter for every new feature (rate, latency, atomic, ...).
+type fileWriterOptions struct {
+	appendToFile    bool
+	rateBytesPerSec int64
+	latency         time.Duration
+	atomic          bool
+	onFull          onFullPolicy
+}
+
 // fileWriter struct to help manage writing to a file
 type fileWriter struct {
+	path   string
+	append bool
 	file   *os.File
 	writer *bufio.Writer
-	active bool
+	// active is read by enqueue from dispatcher goroutines and written by
+	// open/run from the consumer goroutine, so it needs atomic access
+	// rather than a plain bool.
+	active atomic.Bool
+	mu     sync.Mutex
+
+	// rateBytesPerSec and latency implement the optional throttling
+	// subsystem: rateBytesPerSec caps sustained throughput via a token
+	// bucket (0 means unlimited), and latency is slept before every flush
+	// to simulate a slow sink.
+	rateBytesPerSec int64
+	latency         time.Duration
+	tokens          float64
+	lastRefill      time.Time
+	rateMu          sync.Mutex
+
+	// atomic and tmpPath implement the write-to-temp-then-rename mode: when
+	// atomic is set, the open file lives at tmpPath instead of path, and is
+	// only renamed into place by commit on a clean shutdown. abort instead
+	// discards it, leaving whatever was previously at path untouched.
+	atomic  bool
+	tmpPath string
+
+	// ring decouples the dispatcher from this sink's actual disk I/O: a
+	// dedicated goroutine (run) drains it and does the writing, so a slow
+	// sink only ever backs up its own ring, never the dispatcher or other
+	// sinks. onFull governs what happens when it fills up: onFullBlock
+	// bounds memory by waiting for room rather than growing ring without
+	// limit, which does mean a persistently slow block-policy sink
+	// eventually backs up the dispatcher too - that is the trade a caller
+	// who asked for -on-full=block is explicitly accepting.
+	ring    chan []byte
+	onFull  onFullPolicy
+	stopRun chan struct{}
+	runDone chan struct{}
+
+	// sem is shared with every other fileWriter in the container: run
+	// acquires it before actually touching disk (writeChunk, flushPending),
+	// so -j bounds how many sinks may be writing concurrently, not just how
+	// many trivial enqueue calls may be in flight.
+	sem *semaphore.Weighted
 }
 
-// newFileWriter properly initialize a new fileWriter, including catching errors
-func newFileWriter(path string, append bool) (*fileWriter, error) {
+// newFileWriter properly initialize a new fileWriter, including catching
+// errors. sem is shared with every other fileWriter the container creates.
+func newFileWriter(path string, opts fileWriterOptions, sem *semaphore.Weighted) (*fileWriter, error) {
 	s := new(fileWriter)
+	s.path = path
+	s.append = opts.appendToFile
+	s.rateBytesPerSec = opts.rateBytesPerSec
+	s.latency = opts.latency
+	s.tokens = float64(opts.rateBytesPerSec)
+	s.lastRefill = time.Now()
+	s.atomic = opts.atomic && !isFIFOOrStdout(path)
+	s.onFull = opts.onFull
+	s.sem = sem
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	s.ring = make(chan []byte, ringBufferSize)
+	s.stopRun = make(chan struct{})
+	s.runDone = make(chan struct{})
+	go s.run()
+
+	return s, nil
+}
+
+// isFIFOOrStdout reports whether path is /dev/stdout or a named pipe, the
+// two cases where writing to a temp file and renaming over it makes no
+// sense because there is no regular file to atomically replace.
+func isFIFOOrStdout(path string) bool {
+	if path == "/dev/stdout" {
+		return true
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeNamedPipe != 0
+}
+
+// open creates or opens the underlying file at s.path using the fileWriter's
+// append/create semantics, and replaces s.file and s.writer. It is used both
+// by newFileWriter and by reopen so a rotated-away file is picked up the same
+// way it was first opened. In atomic mode it instead creates a temp file
+// alongside s.path; commit or abort decide what becomes of it.
+func (s *fileWriter) open() error {
+	if s.atomic {
+		return s.openTemp()
+	}
 
 	var err error
 	mode := os.O_APPEND
-	if append == false {
+	if s.append == false {
 		mode = os.O_CREATE
 	}
-	if _, err = os.Stat(path); err != nil {
+	if _, err = os.Stat(s.path); err != nil {
 		mode = os.O_CREATE
-		s.file, err = os.Create(path)
+		s.file, err = os.Create(s.path)
 		if err != nil {
 			// Something wrong like bad file path
 			fmt.Fprintln(os.Stderr, err.Error())
-			return nil, err
+			return err
 		}
 	} else {
-		if append == false {
-			s.file, err = os.Create(path)
+		if s.append == false {
+			s.file, err = os.Create(s.path)
 			if err != nil {
 				// Something wrong like bad file path
 				fmt.Fprintln(os.Stderr, err.Error())
-				return nil, err
+				return err
 			}
 		}
 	}
 
-	s.active = true
-	s.file, err = os.OpenFile(path, mode|os.O_WRONLY, 0644)
+	s.active.Store(true)
+	s.file, err = os.OpenFile(s.path, mode|os.O_WRONLY, 0644)
 	if err != nil {
 		// Something wrong like bad file path
 		fmt.Fprintln(os.Stderr, err.Error())
-		return nil, err
+		return err
 	}
 	s.writer = bufio.NewWriter(s.file)
 
-	return s, nil
+	return nil
+}
+
+// openTemp creates "<path>.tmpXXXX" in the same directory as s.path so the
+// eventual rename is within one filesystem, and points s.file/s.writer at
+// it. Append mode has no meaning for a brand new temp file, so atomic mode
+// always starts from an empty file.
+func (s *fileWriter) openTemp() error {
+	dir := filepath.Dir(s.path)
+	base := filepath.Base(s.path)
+
+	f, err := os.CreateTemp(dir, base+".tmp*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+
+	s.active.Store(true)
+	s.file = f
+	s.tmpPath = f.Name()
+	s.writer = bufio.NewWriter(s.file)
+
+	return nil
 }
 
-// write write bytes to the bufio.Writer
-func (s *fileWriter) write(bytes []byte) error {
+// throttle blocks until n bytes worth of tokens have accrued in the token
+// bucket, refilling it based on elapsed wall clock time since the last call.
+// The bucket caps out at one second's worth of tokens so a quiet sink cannot
+// bank unlimited burst capacity. A zero rate means no throttling.
+func (s *fileWriter) throttle(n int) {
+	if s.rateBytesPerSec <= 0 {
+		return
+	}
+
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+
+	need := float64(n)
+	// The burst cap is normally one second's worth of tokens, but a single
+	// write larger than the configured rate (a full read buffer against a
+	// slow rate, say) must still be allowed to drain eventually, so the cap
+	// floats up to whatever the current write needs.
+	burstCap := float64(s.rateBytesPerSec)
+	if need > burstCap {
+		burstCap = need
+	}
+	for {
+		now := time.Now()
+		s.tokens += now.Sub(s.lastRefill).Seconds() * float64(s.rateBytesPerSec)
+		if s.tokens > burstCap {
+			s.tokens = burstCap
+		}
+		s.lastRefill = now
+
+		if s.tokens >= need {
+			s.tokens -= need
+			return
+		}
+
+		wait := time.Duration((need - s.tokens) / float64(s.rateBytesPerSec) * float64(time.Second))
+		time.Sleep(wait)
+	}
+}
+
+// writeChunk writes and (once past the high-water mark) flushes bytes to
+// the bufio.Writer. Throttling happens in writeChunkSem, before s.sem is
+// acquired, since pacing a rate-limited sink's output is unrelated to how
+// many sinks may touch disk at once. It is only ever called from run, so it
+// owns s.mu for the duration of the write.
+func (s *fileWriter) writeChunk(bytes []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if _, err := s.writer.Write(bytes); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return err
 	}
+	if s.writer.Buffered() >= highWaterBytes {
+		return s.flushLocked()
+	}
+	return nil
+}
+
+// flushPending flushes whatever output is currently buffered, if any. Called
+// periodically from run so chunks smaller than highWaterBytes still reach
+// disk in a timely fashion.
+func (s *fileWriter) flushPending() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer.Buffered() == 0 {
+		return
+	}
+	s.flushLocked()
+}
+
+// flushLocked sleeps for s.latency, if set, to simulate a slow sink, then
+// flushes whatever is currently buffered. Callers must hold s.mu.
+func (s *fileWriter) flushLocked() error {
+	if s.latency > 0 {
+		time.Sleep(s.latency)
+	}
 	if err := s.writer.Flush(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return err
@@ -108,52 +361,379 @@ func (s *fileWriter) write(bytes []byte) error {
 	return nil
 }
 
-// close close the underlying writer
-func (s *fileWriter) close() {
+// run drains s.ring, writing each chunk to disk, until stopRun is closed, at
+// which point it drains whatever is already queued, flushes, and exits. It
+// is the only goroutine that calls writeChunk, so concurrent enqueue calls
+// from multiple dispatchers never race on the underlying bufio.Writer. Every
+// actual disk touch (writeChunk, flushPending) is gated by s.sem, so -j
+// bounds how many sinks may be writing at once across the whole container.
+func (s *fileWriter) run() {
+	defer close(s.runDone)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	ctx := context.Background()
+
+	for {
+		select {
+		case chunk, ok := <-s.ring:
+			if !ok {
+				s.flushPendingSem(ctx)
+				return
+			}
+			if err := s.writeChunkSem(ctx, chunk); err != nil {
+				s.active.Store(false)
+			}
+		case <-ticker.C:
+			s.flushPendingSem(ctx)
+		case <-s.stopRun:
+			s.drain()
+			return
+		}
+	}
+}
+
+// drain writes whatever chunks are already queued in the ring without
+// waiting for more, then does a final flush. Used when run is told to stop.
+func (s *fileWriter) drain() {
+	ctx := context.Background()
+
+	for {
+		select {
+		case chunk, ok := <-s.ring:
+			if !ok {
+				s.flushPendingSem(ctx)
+				return
+			}
+			if err := s.writeChunkSem(ctx, chunk); err != nil {
+				s.active.Store(false)
+			}
+		default:
+			s.flushPendingSem(ctx)
+			return
+		}
+	}
+}
+
+// writeChunkSem and flushPendingSem wrap writeChunk/flushPending with an
+// acquire/release of s.sem, the same semaphore every other fileWriter in
+// the container shares, so -j bounds concurrent disk I/O rather than
+// anything dispatch-side. Throttling happens before the semaphore is
+// acquired: -rate paces this sink's own output and has nothing to do with
+// how many sinks may touch disk at once, so it must not hold a slot other
+// sinks' real writes are waiting on.
+func (s *fileWriter) writeChunkSem(ctx context.Context, chunk []byte) error {
+	s.throttle(len(chunk))
+
+	if err := s.sem.Acquire(ctx, 1); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	defer s.sem.Release(1)
+	return s.writeChunk(chunk)
+}
+
+func (s *fileWriter) flushPendingSem(ctx context.Context) {
+	if err := s.sem.Acquire(ctx, 1); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer s.sem.Release(1)
+	s.flushPending()
+}
+
+// enqueue hands bytes to this sink's ring, applying onFull's policy if the
+// ring is currently full. onFullDrop and onFullDisconnect never block;
+// onFullBlock does, which is how back-pressure on a slow sink reaches the
+// dispatcher (and, eventually, stdin) without ring growing without bound.
+func (s *fileWriter) enqueue(bytes []byte) {
+	if !s.active.Load() {
+		return
+	}
+
+	switch s.onFull {
+	case onFullDrop:
+		select {
+		case s.ring <- bytes:
+		default:
+			fmt.Fprintln(os.Stderr, "Dropping chunk, ring full for", s.path)
+		}
+	case onFullDisconnect:
+		select {
+		case s.ring <- bytes:
+		default:
+			fmt.Fprintln(os.Stderr, "Disconnecting, ring full for", s.path)
+			s.active.Store(false)
+		}
+	default: // onFullBlock
+		s.ring <- bytes
+	}
+}
+
+// commit flushes and closes the underlying writer on a clean shutdown. In
+// atomic mode this also fsyncs the temp file and renames it into place at
+// s.path; a non-atomic writer has already been writing s.path directly, so
+// there is nothing left to do beyond the flush and close.
+func (s *fileWriter) commit() {
+	close(s.stopRun)
+	<-s.runDone
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writer.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	if !s.atomic {
+		s.file.Close()
+		return
+	}
+
+	if err := s.file.Sync(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	s.file.Close()
+	if err := os.Rename(s.tmpPath, s.path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// abort flushes and closes the underlying writer on a signal-triggered
+// shutdown. In atomic mode the temp file is removed instead of renamed, so
+// whatever was previously at s.path, if anything, is left untouched.
+func (s *fileWriter) abort() {
+	close(s.stopRun)
+	<-s.runDone
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if err := s.writer.Flush(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 	}
 	s.file.Close()
+
+	if s.atomic {
+		if err := os.Remove(s.tmpPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// reopen flushes and closes the current file and reopens the same path using
+// the original append/create semantics, picking up a new inode left behind
+// by a logrotate-style rename. Writers in flight are blocked on the same
+// mutex used by write, so no bytes are lost or interleaved across the swap.
+//
+// Atomic-mode writers are exempt: their underlying file is always a fresh
+// temp file alongside s.path, not s.path itself, so calling open here would
+// create a second temp file, abandon the one holding everything written so
+// far, and lose it for good once commit only renames the new, near-empty
+// one into place. There is nothing at s.path for logrotate to have rotated
+// out from under an atomic writer in the first place, so skip it.
+func (s *fileWriter) reopen() error {
+	if s.atomic {
+		fmt.Fprintln(os.Stderr, "Ignoring reopen for atomic-mode writer", s.path)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writer.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	s.file.Close()
+
+	return s.open()
 }
 
 // container holds slice of fileWriters
 type container struct {
+	// mu guards fileWriters: addFileWriter appends from the main goroutine
+	// while it's running, but SIGHUP can fire a reopen (and, in principle,
+	// another write) from a separate goroutine at any time.
+	mu          sync.Mutex
 	fileWriters []*fileWriter
+
+	// sem is shared with every fileWriter's run goroutine (see
+	// fileWriter.sem) and bounds how many sinks may be actually writing to
+	// disk concurrently, the same fdSem pattern gofmt uses to cap
+	// concurrent file processing. setConcurrency replaces it once -j is
+	// parsed, which must happen before any fileWriter is created.
+	sem *semaphore.Weighted
 }
 
 // newContainer properly initialize a new container
 func newContainer() *container {
 	c := new(container)
 	c.fileWriters = make([]*fileWriter, 0, 5)
+	c.sem = semaphore.NewWeighted(int64(runtime.NumCPU() + 2))
 
 	return c
 }
 
+// setConcurrency replaces the container's semaphore with one permitting n
+// sinks to be writing to disk at once. Called once from main after the -j
+// flag is parsed and before any fileWriter is created; a non-positive n is a
+// no-op, keeping the default.
+func (c *container) setConcurrency(n int) {
+	if n > 0 {
+		c.sem = semaphore.NewWeighted(int64(n))
+	}
+}
+
 // addFileWriter add a fileWriter to the container's slice
-func (c *container) addFileWriter(path string, appendToFile bool) (*fileWriter, error) {
-	fileWriter, err := newFileWriter(path, appendToFile)
+func (c *container) addFileWriter(path string, opts fileWriterOptions) (*fileWriter, error) {
+	fileWriter, err := newFileWriter(path, opts, c.sem)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Probem obtaining fileWriter for pth", path)
 		return nil, err
 	}
+
+	c.mu.Lock()
 	c.fileWriters = append(c.fileWriters, fileWriter)
+	c.mu.Unlock()
 
 	return fileWriter, nil
 }
 
-// write incoming bytes to all fileWriters
+// snapshot returns a copy of the current fileWriters slice so callers can
+// range over it without holding c.mu for the duration of a write, commit,
+// abort or reopen - all of which can take a while per sink.
+func (c *container) snapshot() []*fileWriter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writers := make([]*fileWriter, len(c.fileWriters))
+	copy(writers, c.fileWriters)
+	return writers
+}
+
+// write dispatches bytes to every fileWriter concurrently instead of the old
+// serial for-loop. Dispatch itself is unbounded - it only calls enqueue (see
+// fileWriter.enqueue), which hands the chunk to the sink's own ring - so
+// write returns as soon as every sink has accepted, queued or rejected the
+// chunk per its -on-full policy. It can still block on a persistently full
+// onFullBlock sink, the same way a plain serial tee would; c.sem plays no
+// part here, since the actual disk I/O it bounds happens later, in each
+// fileWriter's own run goroutine.
 func (c *container) write(bytes []byte) {
-	fmt.Println("got", string(bytes))
-	for _, s := range c.fileWriters {
-		s.write(bytes)
+	chunk := make([]byte, len(bytes))
+	copy(chunk, bytes)
+
+	var wg sync.WaitGroup
+	for _, s := range c.snapshot() {
+		wg.Add(1)
+		go func(s *fileWriter) {
+			defer wg.Done()
+			s.enqueue(chunk)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// commit calls commit on all fileWriters: a clean shutdown, which renames
+// any atomic-mode temp file into place.
+func (c *container) commit() {
+	for _, s := range c.snapshot() {
+		s.commit()
+	}
+}
+
+// abort calls abort on all fileWriters: a signal-triggered shutdown, which
+// discards any atomic-mode temp file instead of renaming it into place.
+func (c *container) abort() {
+	for _, s := range c.snapshot() {
+		s.abort()
+	}
+}
+
+// reopen calls reopen on all fileWriters, logging but otherwise ignoring any
+// individual failure so one bad sink does not stop the others from rotating.
+func (c *container) reopen() {
+	for _, s := range c.snapshot() {
+		if err := s.reopen(); err != nil {
+			fmt.Fprintln(os.Stderr, "Problem reopening", s.path, err)
+		}
 	}
 }
 
-// close call close on all fileWriters
-func (c *container) close() {
-	for _, s := range c.fileWriters {
-		s.close()
+// writePIDFile writes the current process ID to path, truncating any
+// existing contents. Intended to be read by whatever process signals us to
+// reopen (e.g. logrotate's postrotate script).
+func writePIDFile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// parseByteRate parses a bandwidth like "1MiB/s", "512KiB/s" or "100B/s"
+// (the "/s" suffix is optional) into a bytes-per-second value. Units are
+// binary (1KiB == 1024B); a bare number is treated as bytes/second.
+func parseByteRate(rate string) (int64, error) {
+	s := strings.TrimSuffix(strings.TrimSpace(rate), "/s")
+
+	// Ordered longest/most-specific suffix first: "B" is itself a suffix of
+	// "KiB"/"MiB"/"GiB", so checking it first (as a map iteration would, in
+	// random order) can strip only the trailing "B" off a binary unit and
+	// leave the rest unparseable.
+	unitSuffixes := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"GiB", 1024 * 1024 * 1024},
+		{"MiB", 1024 * 1024},
+		{"KiB", 1024},
+		{"B", 1},
 	}
+
+	multiplier := int64(1)
+	for _, u := range unitSuffixes {
+		if strings.HasSuffix(s, u.suffix) {
+			multiplier = u.mult
+			s = strings.TrimSuffix(s, u.suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// parseFileArg splits a destination argument of the form
+// "path.log@rate=512KiB/s@onfull=drop" into its path and a copy of defaults
+// with any "@key=value" attributes applied. Recognized keys are "rate"
+// (see parseByteRate) and "onfull" (see parseOnFullPolicy).
+func parseFileArg(arg string, defaults fileWriterOptions) (path string, opts fileWriterOptions, err error) {
+	parts := strings.Split(arg, "@")
+	path = parts[0]
+	opts = defaults
+
+	for _, attr := range parts[1:] {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return "", opts, fmt.Errorf("bad attribute %q", attr)
+		}
+
+		switch kv[0] {
+		case "rate":
+			opts.rateBytesPerSec, err = parseByteRate(kv[1])
+		case "onfull":
+			opts.onFull, err = parseOnFullPolicy(kv[1])
+		default:
+			err = fmt.Errorf("unknown attribute %q", kv[0])
+		}
+		if err != nil {
+			return "", opts, err
+		}
+	}
+
+	return path, opts, nil
 }
 
 func colour(colour int, input ...string) string {
@@ -210,13 +790,70 @@ func main() {
 	var appendFlag bool
 	flag.BoolVar(&appendFlag, "a", false, "append to files if they already exist")
 
+	var pidFile string
+	flag.StringVar(&pidFile, "p", "", "write the process ID to this file")
+
+	var rateFlag string
+	flag.StringVar(&rateFlag, "rate", "", "default maximum write rate per file, e.g. 1MiB/s (unlimited if unset)")
+
+	var latencyFlag string
+	flag.StringVar(&latencyFlag, "latency", "", "latency to inject before each flush, e.g. 50ms (none if unset)")
+
+	var atomicFlag bool
+	flag.BoolVar(&atomicFlag, "A", false, "write to a temp file and rename over the destination on clean exit")
+	flag.BoolVar(&atomicFlag, "atomic", false, "same as -A")
+
+	var concurrencyFlag int
+	flag.IntVar(&concurrencyFlag, "j", 0, "max fileWriters writing to disk concurrently (default runtime.NumCPU()+2)")
+
+	var onFullFlag string
+	flag.StringVar(&onFullFlag, "on-full", "block", "policy when a sink's ring buffer is full: block, drop or disconnect")
+
 	flag.Parse()
 
+	if pidFile != "" {
+		if err := writePIDFile(pidFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Problem writing pidfile", pidFile, err)
+		}
+	}
+
+	var defaultRate int64
+	if rateFlag != "" {
+		var err error
+		defaultRate, err = parseByteRate(rateFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Problem parsing -rate", rateFlag, err)
+		}
+	}
+
+	var latency time.Duration
+	if latencyFlag != "" {
+		var err error
+		latency, err = time.ParseDuration(latencyFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Problem parsing -latency", latencyFlag, err)
+		}
+	}
+
+	onFull, err := parseOnFullPolicy(onFullFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Problem parsing -on-full", onFullFlag, err)
+	}
+
+	baseOpts := fileWriterOptions{
+		appendToFile:    appendFlag,
+		rateBytesPerSec: defaultRate,
+		latency:         latency,
+		atomic:          atomicFlag,
+		onFull:          onFull,
+	}
+
+	fileContainer.setConcurrency(concurrencyFlag)
+
 	stdoutFlag = !stdoutFlag
 
 	// args are interpreted as paths
 	args := flag.Args()
-	fmt.Println("args", args)
 
 	if helpFlag {
 		out := os.Stderr
@@ -242,14 +879,23 @@ func main() {
 			fmt.Fprintln(os.Stderr, colour(brightRed, "got signal", sig.String()))
 			time.Sleep(100 * time.Millisecond)
 			readWriter.Writer.Flush()
-			for _, s := range fileContainer.fileWriters {
-				s.close()
-			}
+			fileContainer.abort()
 			os.Stderr = stdErr
 			os.Exit(0)
 		}
 	}()
 
+	// Handle SIGHUP the way logrotate expects: reopen each output file at the
+	// same path instead of exiting, so a rename-and-recreate rotation picks
+	// up the new inode on the very next write.
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for sig := range hup {
+			fmt.Fprintln(os.Stderr, colour(brightYellow, "got signal", sig.String(), "- reopening output files"))
+			fileContainer.reopen()
+		}
+	}()
+
 	// Use stdin if available, otherwise exit, as stdin is what this is all about.
 	stat, _ := os.Stdin.Stat()
 	if (stat.Mode() & os.ModeCharDevice) == 0 {
@@ -262,7 +908,12 @@ func main() {
 				fmt.Fprintln(os.Stderr, "Ignoring globbing path", args[i])
 				continue
 			}
-			_, err := fileContainer.addFileWriter(args[i], appendFlag)
+			path, opts, err := parseFileArg(args[i], baseOpts)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Problem parsing attributes for", args[i], err)
+				continue
+			}
+			_, err = fileContainer.addFileWriter(path, opts)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "Probem obtaining fileWriter for pth", args[i])
 			}
@@ -279,36 +930,12 @@ func main() {
 				fmt.Fprintln(os.Stderr, err.Error())
 				break
 			}
-			if err != nil {
-				fmt.Println(err)
-			}
-			//  else {
-			// 	fmt.Println("stdin is from a terminal")
-			// }
-			// if err == io.EOF {
-			// 	fmt.Println("EOF")
-			// }
 
 			if isPrefix {
 				fmt.Fprintln(os.Stderr, "line too long")
 			}
-			// Write line of input to all fileWriters
-			for i := 0; i < len(fileContainer.fileWriters); i++ {
-				fileWriter := fileContainer.fileWriters[i]
-				if fileWriter.active {
-					err := fileWriter.write(
-						[]byte(
-							fmt.Sprintf(
-								"%s\n",
-								string(input),
-							)))
-					fileWriter.writer.Flush()
-					if err != nil {
-						fmt.Fprintln(os.Stderr, err)
-						fileWriter.active = false
-					}
-				}
-			}
+			// Dispatch line of input to all fileWriters
+			fileContainer.write([]byte(fmt.Sprintf("%s\n", string(input))))
 		}
 	}
 
@@ -318,7 +945,12 @@ func main() {
 			fmt.Fprintln(os.Stderr, "Ignoring globbing path", args[i])
 			continue
 		}
-		_, err := fileContainer.addFileWriter(args[i], appendFlag)
+		path, opts, err := parseFileArg(args[i], baseOpts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Problem parsing attributes for", args[i], err)
+			continue
+		}
+		_, err = fileContainer.addFileWriter(path, opts)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Probem obtaining fileWriter for pth", args[i])
 		}
@@ -328,6 +960,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	// On Linux, if stdin is a pipe and every destination is a plain regular
+	// file (no throttling, no atomic mode), splice stdin straight to disk
+	// without ever copying it through a Go buffer. trySpliceFanOut only
+	// returns true once it has consumed all of stdin, so the buffered loop
+	// below is skipped entirely in that case.
+	if trySpliceFanOut(fileContainer.snapshot(), stdoutFlag) {
+		readWriter.Writer.Flush()
+		fileContainer.commit()
+		return
+	}
+
 	buf := make([]byte, 2048)
 	count := 0
 	// eof := false // eof indicates actual ending of input (plus err.EOF)
@@ -340,17 +983,8 @@ func main() {
 		if n == 0 && err == io.EOF {
 			break
 		}
-		// Send bytes to each file fileWriter
-		for i := 0; i < len(fileContainer.fileWriters); i++ {
-			fileWriter := fileContainer.fileWriters[i]
-			if fileWriter.active {
-				err := fileWriter.write(buf[0:n])
-				fileWriter.writer.Flush()
-				if err != nil {
-					fileWriter.active = false
-				}
-			}
-		}
+		// Dispatch bytes to every fileWriter concurrently
+		fileContainer.write(buf[0:n])
 		if stdoutFlag {
 			readWriter.Write(buf[0:n])
 			// The write method for fileWriter.write does flush.
@@ -359,11 +993,11 @@ func main() {
 		count++
 	}
 
-	// // Shut down as cleanluy as possible on interrupt even without the -i flag
-	// readWriter.Flush()
-	// for _, s := range fileContainer.fileWriters {
-	// 	s.close()
-	// }
+	// Clean EOF: commit, which for atomic-mode writers renames their temp
+	// file into place. Non-atomic writers have been writing straight to
+	// their destination all along, so this is just a final flush and close.
+	readWriter.Writer.Flush()
+	fileContainer.commit()
 
 	// if ignoreFlag {
 	// 	// Wait for interupt, or with -i option, kill. Doing it this way allows
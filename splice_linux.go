@@ -0,0 +1,227 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// SPLICE_F_MOVE and SPLICE_F_MORE are the splice(2)/tee(2) flag bits from
+// linux/fs.h. The standard library's syscall package exposes Splice and Tee
+// themselves but not these constants, so they are reproduced here.
+const (
+	spliceFMove = 1
+	spliceFMore = 4
+)
+
+// spliceChunkSize is how much data trySpliceFanOut asks the kernel to move
+// per splice/tee call.
+const spliceChunkSize = 1 << 20 // 1MiB
+
+// trySpliceFanOut attempts to move stdin straight to disk via splice(2),
+// bypassing the bufio.Reader/fileWriter pipeline entirely. It only applies
+// when every writer can actually benefit from zero-copy: stdin must be a
+// pipe, every writer a plain (non-atomic, unthrottled) regular file, and, if
+// forwardStdout is set, stdout must be a pipe too. When none of that holds,
+// it returns false before touching stdin at all, and the caller's normal
+// buffered read loop runs instead. Once it does start moving bytes a false
+// result instead means a splice/tee call itself failed partway through: at
+// that point stdin has already been partially drained, so the caller's
+// buffered fallback will resume mid-stream, not replay everything. A true
+// result means stdin has been fully drained.
+func trySpliceFanOut(writers []*fileWriter, forwardStdout bool) bool {
+	if !spliceEligible(writers, forwardStdout) {
+		return false
+	}
+
+	stdinFd := int(os.Stdin.Fd())
+
+	if len(writers) == 1 && !forwardStdout {
+		return spliceSingle(stdinFd, writers[0])
+	}
+
+	return spliceFanOut(stdinFd, writers, forwardStdout)
+}
+
+// spliceEligible reports whether every precondition for the zero-copy path
+// holds. Throttling and atomic mode both need each chunk to pass through
+// fileWriter's ring/rate/bufio machinery, and forwarding to stdout needs a
+// pipe on the other end too, so any of those rule splicing out.
+func spliceEligible(writers []*fileWriter, forwardStdout bool) bool {
+	if len(writers) == 0 {
+		return false
+	}
+	if !isPipe(os.Stdin) {
+		return false
+	}
+	if forwardStdout && !isPipe(os.Stdout) {
+		return false
+	}
+	for _, s := range writers {
+		if s.atomic || s.rateBytesPerSec > 0 || s.latency > 0 {
+			return false
+		}
+		info, err := s.file.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return false
+		}
+	}
+	return true
+}
+
+// isPipe reports whether f is a FIFO, the only case splice/tee can read from
+// or write to without a regular file's random-access semantics getting in
+// the way.
+func isPipe(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeNamedPipe != 0
+}
+
+// spliceSingle handles the common case of one destination and no stdout
+// forwarding: every byte moves straight from stdin to w's file with no
+// intermediate pipe.
+func spliceSingle(stdinFd int, w *fileWriter) bool {
+	dstFd := int(w.file.Fd())
+	for {
+		n, err := syscall.Splice(stdinFd, nil, dstFd, nil, spliceChunkSize, spliceFMove|spliceFMore)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "splice:", err)
+			return false
+		}
+		if n == 0 {
+			return true
+		}
+	}
+}
+
+// spliceFanOut handles multiple destinations and/or stdout forwarding: tee
+// duplicates each chunk read from stdin into one intermediate pipe per extra
+// destination without consuming it, then splices the original chunk out of
+// stdin into the first destination and out of each intermediate pipe into
+// its own destination.
+func spliceFanOut(stdinFd int, writers []*fileWriter, forwardStdout bool) bool {
+	extra := len(writers) - 1
+	if forwardStdout {
+		extra++
+	}
+
+	readEnds := make([]*os.File, extra)
+	writeEnds := make([]*os.File, extra)
+	for i := range writeEnds {
+		r, w, err := os.Pipe()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "splice:", err)
+			closeAll(readEnds[:i])
+			closeAll(writeEnds[:i])
+			return false
+		}
+		readEnds[i] = r
+		writeEnds[i] = w
+	}
+	defer closeAll(readEnds)
+	defer closeAll(writeEnds)
+
+	for {
+		n, ok := teeAll(stdinFd, writeEnds)
+		if !ok {
+			return false
+		}
+		if n == 0 {
+			return true
+		}
+
+		if err := spliceAll(stdinFd, int(writers[0].file.Fd()), n); err != nil {
+			fmt.Fprintln(os.Stderr, "splice:", err)
+			return false
+		}
+		for i, w := range writers[1:] {
+			if err := spliceAll(int(readEnds[i].Fd()), int(w.file.Fd()), n); err != nil {
+				fmt.Fprintln(os.Stderr, "splice:", err)
+				return false
+			}
+		}
+		if forwardStdout {
+			if err := spliceAll(int(readEnds[extra-1].Fd()), int(os.Stdout.Fd()), n); err != nil {
+				fmt.Fprintln(os.Stderr, "splice:", err)
+				return false
+			}
+		}
+	}
+}
+
+// teeAll duplicates up to spliceChunkSize bytes from stdin into every pipe
+// in dsts without consuming them from stdin, returning how many bytes were
+// duplicated (0 at EOF). The first tee call's count becomes the length cap
+// for the rest, so every pipe ends up holding exactly the same bytes even
+// though nothing stops more data arriving on stdin between the calls.
+func teeAll(stdinFd int, dsts []*os.File) (int64, bool) {
+	if len(dsts) == 0 {
+		return 0, true
+	}
+
+	n, err := teeOne(stdinFd, int(dsts[0].Fd()), spliceChunkSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tee:", err)
+		return 0, false
+	}
+	if n == 0 {
+		return 0, true
+	}
+
+	for _, d := range dsts[1:] {
+		if _, err := teeOne(stdinFd, int(d.Fd()), int(n)); err != nil {
+			fmt.Fprintln(os.Stderr, "tee:", err)
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// teeOne wraps syscall.Tee with EINTR retry.
+func teeOne(rfd, wfd int, max int) (int64, error) {
+	for {
+		n, err := syscall.Tee(rfd, wfd, max, spliceFMove|spliceFMore)
+		if err == syscall.EINTR {
+			continue
+		}
+		return n, err
+	}
+}
+
+// spliceAll moves exactly n bytes from srcFd to dstFd via splice(2), looping
+// over partial transfers and retrying on EINTR.
+func spliceAll(srcFd, dstFd int, n int64) error {
+	for n > 0 {
+		moved, err := syscall.Splice(srcFd, nil, dstFd, nil, int(n), spliceFMove|spliceFMore)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if moved == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		n -= moved
+	}
+	return nil
+}
+
+// closeAll closes every non-nil file in files, ignoring errors - it is only
+// ever used for cleaning up pipe ends on the way out.
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+// trySpliceFanOut is a no-op outside Linux: splice(2) and tee(2) are
+// Linux-only syscalls, so every other platform always falls back to the
+// normal buffered copy loop in main.
+func trySpliceFanOut(writers []*fileWriter, forwardStdout bool) bool {
+	return false
+}